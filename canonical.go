@@ -0,0 +1,264 @@
+package capnp
+
+// Canonicalization implements the canonical Cap'n Proto encoding: a
+// deterministic, single-segment layout with no far pointers, where struct
+// data and pointer sections are truncated to drop trailing zero words and
+// null pointers, and every object is written in tree (pre-)order starting
+// at word 0. Two messages with the same contents but differing
+// segmentation, pointer order, or padding produce identical canonical
+// bytes, which makes the encoding suitable for hashing and signing. Lists
+// keep their element encoding: a list of primitives and a list of
+// one-field structs that Equal reports as equal still encode differently.
+
+// MarshalCanonical returns the canonical single-segment encoding of the
+// message's root pointer: just the segment's bytes, with no stream
+// framing header. See Ptr.MarshalCanonical.
+func (m *Message) MarshalCanonical() ([]byte, error) {
+	root, err := m.Root()
+	if err != nil {
+		return nil, err
+	}
+	return root.MarshalCanonical()
+}
+
+// MarshalCanonical returns the canonical single-segment encoding of p, as
+// defined by the Cap'n Proto spec: just the segment's bytes, with no
+// stream framing header, since the header is specific to the streaming
+// wire format rather than part of the canonical value itself. This is
+// the representation IsCanonical checks against, and is what should be
+// hashed or signed -- not the output of Message.Marshal. See IsCanonical
+// for the full definition of "canonical" used here.
+func (p Ptr) MarshalCanonical() ([]byte, error) {
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		return nil, err
+	}
+	cc := &canonicalCopier{dst: seg}
+	if err := cc.copyRoot(p); err != nil {
+		return nil, err
+	}
+	return cc.dst.Data(), nil
+}
+
+// canonicalCopier walks a source object graph and writes a canonical copy
+// of it into dst, a single, initially-empty segment.
+type canonicalCopier struct {
+	dst *Segment
+}
+
+func (cc *canonicalCopier) copyRoot(p Ptr) error {
+	// The root pointer itself occupies word 0; the object it points to
+	// is allocated (in tree order) immediately after.
+	if _, err := cc.alloc(Size(wordSize)); err != nil {
+		return err
+	}
+	return cc.writeCanonicalPtr(0, p)
+}
+
+// writeCanonicalPtr writes a canonical copy of src as the pointer word at
+// off in cc.dst, allocating the copy (in tree order) if src is a struct
+// or list.
+func (cc *canonicalCopier) writeCanonicalPtr(off Address, src Ptr) error {
+	if !src.IsValid() {
+		cc.dst.writeRawPointer(off, 0)
+		return nil
+	}
+	switch src.flags.ptrType() {
+	case structPtrType:
+		return cc.writeCanonicalStruct(off, src.Struct())
+	case listPtrType:
+		return cc.writeCanonicalList(off, src.List())
+	case interfacePtrType:
+		return errOtherPointer
+	default:
+		panic("unreachable")
+	}
+}
+
+// truncatedSize returns the struct's ObjectSize with trailing all-zero
+// data words and trailing null pointer words dropped.
+func truncatedSize(st Struct) ObjectSize {
+	dataWords := int(st.size.DataSize / 8)
+	for dataWords > 0 {
+		word := st.seg.slice(st.off+Address((dataWords-1)*8), 8)
+		if !isZeroFilled(word) {
+			break
+		}
+		dataWords--
+	}
+	ptrs := int(st.size.PointerCount)
+	for ptrs > 0 && !st.HasPtr(uint16(ptrs-1)) {
+		ptrs--
+	}
+	return ObjectSize{
+		DataSize:     Size(dataWords * 8),
+		PointerCount: uint16(ptrs),
+	}
+}
+
+func (cc *canonicalCopier) writeCanonicalStruct(off Address, st Struct) error {
+	sz := truncatedSize(st)
+	newAddr, err := cc.alloc(sz.totalSize())
+	if err != nil {
+		return err
+	}
+	dst := Struct{seg: cc.dst, off: newAddr, size: sz, depthLimit: maxDepth}
+	copy(cc.dst.data[dst.off:], st.seg.slice(st.off, sz.DataSize))
+	cc.dst.writeRawPointer(off, dst.ToPtr().value(off))
+	ptrBase := dst.off + Address(sz.DataSize)
+	for i := uint16(0); i < sz.PointerCount; i++ {
+		child, err := st.Ptr(i)
+		if err != nil {
+			return err
+		}
+		if err := cc.writeCanonicalPtr(ptrBase+Address(i)*Address(wordSize), child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cc *canonicalCopier) writeCanonicalList(off Address, l List) error {
+	switch {
+	case l.flags&isCompositeList != 0:
+		return cc.writeCanonicalCompositeList(off, l)
+	case l.flags&isBitList != 0:
+		// Bit lists pack elements at sub-byte granularity, so their
+		// byte extent comes from allocSize, not size.totalSize()*length
+		// (size is the zero ObjectSize for bit lists).
+		return cc.writeCanonicalDataList(off, l, l.allocSize())
+	case l.size.PointerCount == 0:
+		// Data-only list: copy verbatim, no truncation applies to
+		// individual elements.
+		sz, _ := l.size.totalSize().times(l.length)
+		return cc.writeCanonicalDataList(off, l, sz)
+	default:
+		// A plain list of pointers (List(Text), List(List(T)), ...),
+		// as opposed to a list of structs. Each element is one pointer
+		// word; there is no tag word and no struct truncation to
+		// apply, so it must stay encoded as a pointer list rather than
+		// being promoted to a composite struct list.
+		return cc.writeCanonicalPointerList(off, l)
+	}
+}
+
+// writeCanonicalDataList copies a non-composite, non-pointer list's sz
+// bytes of element data verbatim.
+func (cc *canonicalCopier) writeCanonicalDataList(off Address, l List, sz Size) error {
+	newAddr, err := cc.alloc(sz)
+	if err != nil {
+		return err
+	}
+	copy(cc.dst.data[newAddr:], l.seg.slice(l.off, sz))
+	cc.dst.writeRawPointer(off, List{seg: cc.dst, off: newAddr, length: l.length, size: l.size, flags: l.flags}.ToPtr().value(off))
+	return nil
+}
+
+// writeCanonicalPointerList canonicalizes each element of a non-composite
+// pointer list independently, preserving the pointer-list encoding.
+func (cc *canonicalCopier) writeCanonicalPointerList(off Address, l List) error {
+	newAddr, err := cc.alloc(Size(l.length) * wordSize)
+	if err != nil {
+		return err
+	}
+	cc.dst.writeRawPointer(off, List{seg: cc.dst, off: newAddr, length: l.length, size: l.size, flags: l.flags}.ToPtr().value(off))
+	for i := 0; i < l.Len(); i++ {
+		srcAddr, ok := l.off.addSize(Size(i) * wordSize)
+		if !ok {
+			return errOverflow
+		}
+		child, err := l.seg.readPtr(srcAddr, l.depthLimit)
+		if err != nil {
+			return err
+		}
+		dstAddr, ok := newAddr.addSize(Size(i) * wordSize)
+		if !ok {
+			return errOverflow
+		}
+		if err := cc.writeCanonicalPtr(dstAddr, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCanonicalCompositeList canonicalizes a list of structs, truncating
+// every element to the widest element actually used so they remain a
+// uniform array, per the canonical encoding's tag word rule.
+func (cc *canonicalCopier) writeCanonicalCompositeList(off Address, l List) error {
+	var sz ObjectSize
+	for i := 0; i < l.Len(); i++ {
+		esz := truncatedSize(l.Struct(i))
+		if esz.DataSize > sz.DataSize {
+			sz.DataSize = esz.DataSize
+		}
+		if esz.PointerCount > sz.PointerCount {
+			sz.PointerCount = esz.PointerCount
+		}
+	}
+	elemSize, _ := sz.totalSize().times(l.length)
+	tagAddr, err := cc.alloc(wordSize + elemSize)
+	if err != nil {
+		return err
+	}
+	cc.dst.writeRawPointer(tagAddr, rawStructPointer(Address(l.length), sz))
+	base, _ := tagAddr.addSize(wordSize)
+	cc.dst.writeRawPointer(off, List{seg: cc.dst, off: base, length: l.length, size: sz, flags: isCompositeList}.ToPtr().value(off))
+	for i := 0; i < l.Len(); i++ {
+		elemOff := base + Address(i)*Address(sz.totalSize())
+		src := l.Struct(i)
+		copy(cc.dst.data[elemOff:], src.seg.slice(src.off, sz.DataSize))
+		ptrBase := elemOff + Address(sz.DataSize)
+		for j := uint16(0); j < sz.PointerCount; j++ {
+			child, err := src.Ptr(j)
+			if err != nil {
+				return err
+			}
+			if err := cc.writeCanonicalPtr(ptrBase+Address(j)*Address(wordSize), child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// alloc grows cc.dst by sz and returns the address of the new region.
+// Because canonical encoding lives in a single segment, this is simpler
+// than the general-purpose alloc used elsewhere: it never needs to pick a
+// segment.
+func (cc *canonicalCopier) alloc(sz Size) (Address, error) {
+	sz = sz.padToWord()
+	addr := Address(len(cc.dst.data))
+	end, ok := addr.addSize(sz)
+	if !ok {
+		return 0, errOverflow
+	}
+	cc.dst.data = append(cc.dst.data, make([]byte, sz)...)
+	_ = end
+	return addr, nil
+}
+
+// IsCanonical reports whether data is the canonical single-segment
+// encoding of its root pointer, as produced by MarshalCanonical: a single
+// segment, no far pointers, struct data and pointer sections truncated of
+// trailing zeros, and every object laid out in tree order with no gaps.
+func IsCanonical(data []byte) (bool, error) {
+	msg := &Message{Arena: SingleSegment(data)}
+	root, err := msg.Root()
+	if err != nil {
+		return false, err
+	}
+	canon, err := root.MarshalCanonical()
+	if err != nil {
+		return false, err
+	}
+	if len(canon) != len(data) {
+		return false, nil
+	}
+	for i := range data {
+		if data[i] != canon[i] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -135,9 +135,11 @@ func (s *Segment) readPtr(off Address, depthLimit uint) (ptr Ptr, err error) {
 		if err != nil {
 			return Ptr{}, err
 		}
-		if !s.msg.canRead(sp.readSize()) {
-			return Ptr{}, errReadLimit
+		leave, err := s.msg.traversalTracker().Enter(s, sp.off, sp.readSize())
+		if err != nil {
+			return Ptr{}, err
 		}
+		leave()
 		sp.depthLimit = depthLimit - 1
 		return sp.ToPtr(), nil
 	case listPointer:
@@ -145,9 +147,11 @@ func (s *Segment) readPtr(off Address, depthLimit uint) (ptr Ptr, err error) {
 		if err != nil {
 			return Ptr{}, err
 		}
-		if !s.msg.canRead(lp.readSize()) {
-			return Ptr{}, errReadLimit
+		leave, err := s.msg.traversalTracker().Enter(s, lp.off, lp.readSize())
+		if err != nil {
+			return Ptr{}, err
 		}
+		leave()
 		lp.depthLimit = depthLimit - 1
 		return lp.ToPtr(), nil
 	case otherPointer:
@@ -282,6 +286,11 @@ func (s *Segment) resolveFarPointer(off Address, val rawPointer) (*Segment, Addr
 }
 
 func (s *Segment) writePtr(off Address, src Ptr, forceCopy bool) error {
+	ctx := newCopyContext(s.msg.CopyOptions.PreserveSharing)
+	return s.writePtrCtx(ctx, off, src, forceCopy)
+}
+
+func (s *Segment) writePtrCtx(ctx *copyContext, off Address, src Ptr, forceCopy bool) error {
 	if !src.IsValid() {
 		s.writeRawPointer(off, 0)
 		return nil
@@ -291,60 +300,107 @@ func (s *Segment) writePtr(off Address, src Ptr, forceCopy bool) error {
 	case structPtrType:
 		st := src.Struct()
 		if forceCopy || src.seg.msg != s.msg || st.flags&isListMember != 0 {
-			newSeg, newAddr, err := alloc(s, st.size.totalSize())
-			if err != nil {
-				return err
-			}
-			dst := Struct{
-				seg:        newSeg,
-				off:        newAddr,
-				size:       st.size,
-				depthLimit: maxDepth,
-				// clear flags
+			start, end := st.off, st.off
+			dedup := false
+			if ctx.preserveSharing {
+				end, _ = start.addSize(st.size.totalSize())
+				if dstSeg, dstAddr, ok, err := ctx.enter(st.seg.id, start, end); err != nil {
+					return err
+				} else if ok {
+					// Already copied elsewhere in this traversal:
+					// reuse that destination instead of copying
+					// again. Route it through the same local/far
+					// pointer logic below rather than writing the
+					// pointer word directly, since the earlier copy
+					// may have landed in a different segment of the
+					// destination message than s.
+					src = Struct{seg: dstSeg, off: dstAddr, size: st.size}.ToPtr()
+					dedup = true
+				}
 			}
-			if err := copyStruct(dst, st); err != nil {
-				return err
+			if !dedup {
+				newSeg, newAddr, err := alloc(s, st.size.totalSize())
+				if err != nil {
+					return err
+				}
+				dst := Struct{
+					seg:        newSeg,
+					off:        newAddr,
+					size:       st.size,
+					depthLimit: maxDepth,
+					// clear flags
+				}
+				if err := copyStruct(ctx, dst, st); err != nil {
+					return err
+				}
+				if ctx.preserveSharing {
+					ctx.leave(st.seg.id, start, end, newSeg, newAddr)
+				}
+				src = dst.ToPtr()
 			}
-			src = dst.ToPtr()
 		}
 	case listPtrType:
 		if forceCopy || src.seg.msg != s.msg {
 			l := src.List()
 			sz := l.allocSize()
-			newSeg, newAddr, err := alloc(s, sz)
-			if err != nil {
-				return err
-			}
-			dst := List{
-				seg:        newSeg,
-				off:        newAddr,
-				length:     l.length,
-				size:       l.size,
-				flags:      l.flags,
-				depthLimit: maxDepth,
-			}
-			if dst.flags&isCompositeList != 0 {
-				// Copy tag word
-				newSeg.writeRawPointer(newAddr, l.seg.readRawPointer(l.off-Address(wordSize)))
-				var ok bool
-				dst.off, ok = dst.off.addSize(wordSize)
-				if !ok {
-					return errOverflow
+			start, end := l.off, l.off
+			dedup := false
+			if ctx.preserveSharing {
+				if l.flags&isCompositeList != 0 {
+					// allocSize counts the tag word that precedes l.off.
+					start -= Address(wordSize)
+				}
+				end, _ = start.addSize(sz)
+				if dstSeg, dstAddr, ok, err := ctx.enter(l.seg.id, start, end); err != nil {
+					return err
+				} else if ok {
+					// See the equivalent structPtrType branch above:
+					// fall through to the local/far pointer logic
+					// below instead of writing the pointer word here,
+					// since dstSeg may not be s.
+					src = List{seg: dstSeg, off: dstAddr, length: l.length, size: l.size, flags: l.flags}.ToPtr()
+					dedup = true
 				}
-				sz -= wordSize
 			}
-			if dst.flags&isBitList != 0 || dst.size.PointerCount == 0 {
-				end, _ := l.off.addSize(sz) // list has already validated
-				copy(newSeg.data[dst.off:], l.seg.data[l.off:end])
-			} else {
-				for i := 0; i < l.Len(); i++ {
-					err := copyStruct(dst.Struct(i), l.Struct(i))
-					if err != nil {
-						return err
+			if !dedup {
+				newSeg, newAddr, err := alloc(s, sz)
+				if err != nil {
+					return err
+				}
+				dst := List{
+					seg:        newSeg,
+					off:        newAddr,
+					length:     l.length,
+					size:       l.size,
+					flags:      l.flags,
+					depthLimit: maxDepth,
+				}
+				if dst.flags&isCompositeList != 0 {
+					// Copy tag word
+					newSeg.writeRawPointer(newAddr, l.seg.readRawPointer(l.off-Address(wordSize)))
+					var ok bool
+					dst.off, ok = dst.off.addSize(wordSize)
+					if !ok {
+						return errOverflow
+					}
+					sz -= wordSize
+				}
+				if dst.flags&isBitList != 0 || dst.size.PointerCount == 0 {
+					end, _ := l.off.addSize(sz) // list has already validated
+					copy(newSeg.data[dst.off:], l.seg.data[l.off:end])
+				} else {
+					for i := 0; i < l.Len(); i++ {
+						err := copyStruct(ctx, dst.Struct(i), l.Struct(i))
+						if err != nil {
+							return err
+						}
 					}
 				}
+				if ctx.preserveSharing {
+					ctx.leave(l.seg.id, start, end, newSeg, dst.off)
+				}
+				src = dst.ToPtr()
 			}
-			src = dst.ToPtr()
 		}
 	case interfacePtrType:
 		i := src.Interface()
@@ -406,7 +462,36 @@ func (s *Segment) writePtr(off Address, src Ptr, forceCopy bool) error {
 //	  populated.
 //	- Two null pointers are equal.
 //	- All other combinations of things are not equal.
+//
+// Equal does not permanently consume read-traversal budget from either
+// pointer's Message: it snapshots each one's TraversalTracker before
+// comparing and restores it afterward, so comparing a subtree does not
+// count against the budget available to the rest of the message's reads.
 func Equal(p1, p2 Ptr) (bool, error) {
+	for _, p := range [2]Ptr{p1, p2} {
+		if !p.IsValid() {
+			continue
+		}
+		var msg *Message
+		switch p.flags.ptrType() {
+		case structPtrType:
+			msg = p.Struct().seg.msg
+		case listPtrType:
+			msg = p.List().seg.msg
+		case interfacePtrType:
+			msg = p.Interface().Message()
+		}
+		if msg == nil {
+			continue
+		}
+		snap := msg.traversalTracker().Snapshot()
+		defer msg.traversalTracker().Restore(snap)
+	}
+	return equal(p1, p2)
+}
+
+// equal is the recursive implementation behind Equal.
+func equal(p1, p2 Ptr) (bool, error) {
 	if !p1.IsValid() && !p2.IsValid() {
 		return true, nil
 	}
@@ -455,7 +540,7 @@ func Equal(p1, p2 Ptr) (bool, error) {
 			if err != nil {
 				return false, err
 			}
-			if ok, err := Equal(sp1, sp2); !ok || err != nil {
+			if ok, err := equal(sp1, sp2); !ok || err != nil {
 				return false, err
 			}
 		}
@@ -485,7 +570,7 @@ func Equal(p1, p2 Ptr) (bool, error) {
 		}
 		for i := 0; i < l1.Len(); i++ {
 			e1, e2 := l1.Struct(i), l2.Struct(i)
-			if ok, err := Equal(e1.ToPtr(), e2.ToPtr()); !ok || err != nil {
+			if ok, err := equal(e1.ToPtr(), e2.ToPtr()); !ok || err != nil {
 				return false, err
 			}
 		}
@@ -533,4 +618,5 @@ var (
 	errCopyDepth   = errors.New("capnp: copy depth too large")
 	errOverlap     = errors.New("capnp: overlapping data on copy")
 	errListSize    = errors.New("capnp: invalid list size")
+	errCycle       = errors.New("capnp: cycle detected while copying pointer")
 )
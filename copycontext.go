@@ -0,0 +1,141 @@
+package capnp
+
+import "sort"
+
+// A copyContext tracks the objects that have been visited during a single
+// writePtr traversal so that shared subgraphs are copied once instead of
+// once per reference, and so that a cycle in the source graph is reported
+// as an error instead of recursing until the stack overflows.
+//
+// The context is keyed by the source region being copied: a segment ID
+// plus the half-open byte range [start, end) that the struct or list
+// occupies in that segment.  Struct and list regions never partially
+// overlap one another on a well-formed wire -- a child pointer's region is
+// always either disjoint from or fully nested inside its parent's -- so an
+// overlapping-but-unequal match during lookup means the source graph
+// changed underneath us (e.g. via concurrent mutation) and is treated as
+// an error rather than silently copying stale data.
+type copyContext struct {
+	preserveSharing bool
+	segs            map[SegmentID]*copyIntervalSet
+}
+
+// copyInterval is a half-open byte range [start, end) in a source segment
+// that has either already been copied to (dstSeg, dst), or is currently
+// being copied (dstSeg is nil and inProgress is true). dstSeg is tracked
+// alongside the address because the destination message may have spilled
+// the copy into a segment other than the one the caller is writing into.
+type copyInterval struct {
+	start, end Address
+	dstSeg     *Segment
+	dst        Address
+	inProgress bool
+}
+
+// copyIntervalSet holds the copyIntervals for a single source segment,
+// kept sorted by start address. Because struct/list regions form a
+// laminar family on a well-formed wire (a child's region is always
+// either disjoint from or fully nested inside its parent's, never
+// partially overlapping), at most one existing interval can ever overlap
+// a query -- it is adjacent, in sorted order, to where the query's start
+// would be inserted. That lets find do a binary search plus two
+// constant-time neighbor checks instead of a linear scan, which matters
+// because TraversalTracker calls find on every pointer read, not just
+// while copying.
+type copyIntervalSet struct {
+	ivs []copyInterval
+}
+
+func newCopyContext(preserveSharing bool) *copyContext {
+	return &copyContext{
+		preserveSharing: preserveSharing,
+		segs:            make(map[SegmentID]*copyIntervalSet),
+	}
+}
+
+func (ctx *copyContext) setFor(id SegmentID) *copyIntervalSet {
+	set := ctx.segs[id]
+	if set == nil {
+		set = &copyIntervalSet{}
+		ctx.segs[id] = set
+	}
+	return set
+}
+
+// find returns the interval overlapping [start, end), or nil if there is
+// none. It runs in O(log n) time: a binary search for where start would
+// sort, followed by checking only the (at most one) overlapping neighbor
+// on either side -- see the copyIntervalSet doc comment for why that
+// suffices.
+func (set *copyIntervalSet) find(start, end Address) *copyInterval {
+	i := sort.Search(len(set.ivs), func(i int) bool { return set.ivs[i].start >= start })
+	if i > 0 {
+		if prev := &set.ivs[i-1]; prev.start < end && start < prev.end {
+			return prev
+		}
+	}
+	if i < len(set.ivs) {
+		if cur := &set.ivs[i]; cur.start < end && start < cur.end {
+			return cur
+		}
+	}
+	return nil
+}
+
+// insert adds iv to the set, keeping it sorted by start address.
+func (set *copyIntervalSet) insert(iv copyInterval) {
+	i := sort.Search(len(set.ivs), func(i int) bool { return set.ivs[i].start >= iv.start })
+	set.ivs = append(set.ivs, copyInterval{})
+	copy(set.ivs[i+1:], set.ivs[i:])
+	set.ivs[i] = iv
+}
+
+// enter records that [start, end) in segment id is currently being
+// copied. It returns errCycle if the region is already in progress (a
+// cycle), and errOverlap if an overlapping region with a different extent
+// was recorded (the graph mutated under us).
+// If the region was already fully copied, enter returns the segment and
+// address it was copied to and ok == true so the caller can emit a
+// pointer to it instead of copying again.
+func (ctx *copyContext) enter(id SegmentID, start, end Address) (dstSeg *Segment, dst Address, ok bool, err error) {
+	set := ctx.setFor(id)
+	if iv := set.find(start, end); iv != nil {
+		if iv.start != start || iv.end != end {
+			return nil, 0, false, errOverlap
+		}
+		if iv.inProgress {
+			return nil, 0, false, errCycle
+		}
+		return iv.dstSeg, iv.dst, true, nil
+	}
+	set.insert(copyInterval{start: start, end: end, inProgress: true})
+	return nil, 0, false, nil
+}
+
+// leave marks [start, end) in segment id as finished, recording
+// (dstSeg, dst) as its destination so later references resolve there
+// instead of being copied again.
+func (ctx *copyContext) leave(id SegmentID, start, end Address, dstSeg *Segment, dst Address) {
+	set := ctx.setFor(id)
+	if iv := set.find(start, end); iv != nil {
+		iv.inProgress = false
+		iv.dstSeg = dstSeg
+		iv.dst = dst
+	}
+}
+
+// CopyOptions controls how Segment.writePtr treats shared and cyclic
+// structure while copying an object graph into a new message or segment.
+//
+// The zero value matches the historical behavior: every reference to a
+// shared object is deep-copied independently, and a cycle introduced by
+// an application (for example, through Orphan surgery) causes unbounded
+// recursion. Setting PreserveSharing lets callers opt into the safer, if
+// slightly more expensive, sharing-aware copy.
+type CopyOptions struct {
+	// PreserveSharing, when true, makes writePtr deduplicate references
+	// to an already-copied source object (preserving the DAG shape of
+	// the source graph in the copy) and return errCycle instead of
+	// recursing forever when it detects a cycle.
+	PreserveSharing bool
+}
@@ -0,0 +1,172 @@
+package capnp
+
+import "errors"
+
+// An Orphan is a pointer that has been allocated in a message but is not
+// (or is no longer) referenced by any other object in the message's
+// graph. It is produced by Struct.Disown/List.Disown, which detach an
+// existing pointer from its parent without copying the pointed-to data,
+// and consumed by Struct.Adopt/List.Adopt, which install it somewhere
+// else -- again without copying. This makes moving or reparenting an
+// object, or building up a list out of order, cheap compared to the
+// forced deep copy that writePtr(..., forceCopy=true) otherwise performs.
+//
+// The zero Orphan is invalid, analogous to the zero Ptr.
+type Orphan struct {
+	seg  *Segment
+	addr Address
+	ptr  Ptr
+}
+
+// IsValid reports whether o refers to an orphaned object, as opposed to
+// being the zero Orphan (the orphan equivalent of a null pointer).
+func (o Orphan) IsValid() bool {
+	return o.ptr.IsValid()
+}
+
+// Ptr returns the orphaned pointer itself, without adopting it anywhere.
+// Reading through the result is safe; writing it into another object must
+// go through Adopt so the message knows the region is no longer orphaned.
+func (o Orphan) Ptr() Ptr {
+	return o.ptr
+}
+
+// Message returns the message that owns the orphan's memory.
+func (o Orphan) Message() *Message {
+	if o.seg == nil {
+		return nil
+	}
+	return o.seg.msg
+}
+
+// structPtrAddr returns the address of st's field'th pointer word.
+func structPtrAddr(st Struct, field uint16) (Address, bool) {
+	if field >= st.size.PointerCount {
+		return 0, false
+	}
+	return st.off.addSize(st.size.DataSize + Size(field)*wordSize)
+}
+
+// Disown detaches the pointer at the given field from st, zeroing the
+// pointer word in st so the parent no longer references the object, and
+// returns a descriptor for the now-unreferenced memory. The struct's data
+// and pointer sections are otherwise unaffected.
+func (st Struct) Disown(field uint16) Orphan {
+	addr, ok := structPtrAddr(st, field)
+	if !ok {
+		return Orphan{}
+	}
+	p, err := st.seg.readPtr(addr, st.depthLimit)
+	if err != nil || !p.IsValid() {
+		return Orphan{}
+	}
+	st.seg.writeRawPointer(addr, 0)
+	return Orphan{seg: st.seg, addr: addr, ptr: p}
+}
+
+// Adopt installs o as the pointer at the given field of st, without
+// copying the orphaned data. After Adopt returns, o must not be used
+// again (its memory now belongs to st). Adopt returns an error if o
+// belongs to a different Message than st, since a pointer can only be
+// adopted within the message it was allocated in.
+func (st Struct) Adopt(field uint16, o Orphan) error {
+	addr, ok := structPtrAddr(st, field)
+	if !ok {
+		return errObjectSize
+	}
+	if o.IsValid() && o.Message() != st.seg.msg {
+		return errWrongMessage
+	}
+	return st.seg.writePtr(addr, o.ptr, false)
+}
+
+// isPointerList reports whether l's elements are plain pointer words, as
+// opposed to composite structs or inline primitive data -- the only
+// shape Disown/Adopt can safely treat an element as a detachable pointer.
+func isPointerList(l List) bool {
+	return l.flags&isCompositeList == 0 && l.size.PointerCount == 1 && l.size.DataSize == 0
+}
+
+// listPtrAddr returns the address of the i'th element of l, which must be
+// a list of pointers (for example a List(Text) or a List(List(T))).
+func listPtrAddr(l List, i int) (Address, bool) {
+	if i < 0 || i >= l.Len() || !isPointerList(l) {
+		return 0, false
+	}
+	return l.off.addSize(Size(i) * l.size.totalSize())
+}
+
+// Disown detaches the pointer at index i of l, zeroing the pointer word
+// so the list no longer references the object, and returns a descriptor
+// for the now-unreferenced memory. l must be a plain pointer list (for
+// example a List(Text) or a List(List(T))); calling Disown on a
+// composite-struct list or a primitive data list returns the zero
+// Orphan, since there is no single pointer word at element i to detach.
+func (l List) Disown(i int) Orphan {
+	addr, ok := listPtrAddr(l, i)
+	if !ok {
+		return Orphan{}
+	}
+	p, err := l.seg.readPtr(addr, l.depthLimit)
+	if err != nil || !p.IsValid() {
+		return Orphan{}
+	}
+	l.seg.writeRawPointer(addr, 0)
+	return Orphan{seg: l.seg, addr: addr, ptr: p}
+}
+
+// Adopt installs o as the pointer at index i of l, without copying the
+// orphaned data. After Adopt returns, o must not be used again. As with
+// Disown, l must be a plain pointer list; Adopt returns errObjectSize for
+// a composite-struct or primitive-data list rather than writing into the
+// middle of an element's inline data.
+func (l List) Adopt(i int, o Orphan) error {
+	if !isPointerList(l) {
+		return errObjectSize
+	}
+	addr, ok := listPtrAddr(l, i)
+	if !ok {
+		return errPointerAddress
+	}
+	if o.IsValid() && o.Message() != l.seg.msg {
+		return errWrongMessage
+	}
+	return l.seg.writePtr(addr, o.ptr, false)
+}
+
+// Release overwrites the orphan's region with zeros. After Release, o
+// must not be adopted. Release does not touch the message's
+// TraversalTracker: budget already charged for reading the region is not
+// refunded.
+//
+// The region zeroed is the orphaned object's own segment, which is not
+// necessarily o's parent segment: the pointer Disown detached may have
+// been a far pointer into another segment of the same message.
+func (o Orphan) Release() {
+	if !o.IsValid() {
+		return
+	}
+	var seg *Segment
+	var base Address
+	var sz Size
+	switch o.ptr.flags.ptrType() {
+	case structPtrType:
+		st := o.ptr.Struct()
+		seg, base, sz = st.seg, st.off, st.size.totalSize()
+	case listPtrType:
+		l := o.ptr.List()
+		seg, base, sz = l.seg, l.off, l.allocSize()
+		if l.flags&isCompositeList != 0 {
+			// allocSize includes the tag word immediately preceding
+			// l.off, which must be zeroed along with the elements.
+			base -= Address(wordSize)
+		}
+	default:
+		return
+	}
+	for i := Address(0); i < Address(sz); i++ {
+		seg.writeUint8(base+i, 0)
+	}
+}
+
+var errWrongMessage = errors.New("capnp: orphan does not belong to the target message")
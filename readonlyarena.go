@@ -0,0 +1,121 @@
+package capnp
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// ReadOnlyArena is an Arena that serves segments as subslices of a single
+// caller-owned buffer instead of copying them in. It is meant to be paired
+// with a memory-mapped file: Message.Segment returns a Segment whose Data
+// aliases the mapping directly, so reading a message never copies bytes
+// and never allocates beyond the small bookkeeping below.
+//
+// A ReadOnlyArena cannot be allocated into; any attempt to grow it through
+// the normal alloc path returns errReadOnlyArena.
+type ReadOnlyArena struct {
+	data []byte
+	segs []Segment
+}
+
+// ReadFromMemoryZeroCopy parses the stream framing header of data in
+// place and returns a Message backed by a ReadOnlyArena whose segments
+// alias data. Unlike Unmarshal, it never copies the segment contents, so
+// the caller must keep data alive (and unmodified) for as long as the
+// Message is in use -- exactly the lifetime a mmap'd []byte already has.
+func ReadFromMemoryZeroCopy(data []byte) (*Message, error) {
+	arena, err := newReadOnlyArena(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Arena: arena}, nil
+}
+
+// parseStreamHeader reads the standard Cap'n Proto stream framing header
+// (segment count and each segment's size in words) from the front of
+// data, returning the per-segment word counts and the byte offset of the
+// first segment's data.
+func parseStreamHeader(data []byte) (segWords []uint32, tableSize int, err error) {
+	if len(data) < 4 {
+		return nil, 0, errOutOfBounds
+	}
+	n := binary.LittleEndian.Uint32(data[0:4]) + 1
+	hdrSize := 4 + int(n)*4
+	hdrSize = (hdrSize + int(wordSize) - 1) / int(wordSize) * int(wordSize)
+	if len(data) < hdrSize {
+		return nil, 0, errOutOfBounds
+	}
+	segWords = make([]uint32, n)
+	for i := range segWords {
+		segWords[i] = binary.LittleEndian.Uint32(data[4+i*4 : 8+i*4])
+	}
+	return segWords, hdrSize, nil
+}
+
+func newReadOnlyArena(data []byte) (*ReadOnlyArena, error) {
+	hdr, tableSize, err := parseStreamHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	arena := &ReadOnlyArena{data: data}
+	off := tableSize
+	for i, sz := range hdr {
+		end := off + int(sz)*int(wordSize)
+		if end > len(data) {
+			return nil, errOutOfBounds
+		}
+		arena.segs = append(arena.segs, Segment{
+			id:   SegmentID(i),
+			data: data[off:end:end],
+		})
+		off = end
+	}
+	return arena, nil
+}
+
+// NumSegments returns the number of segments in the arena.
+func (ra *ReadOnlyArena) NumSegments() int64 {
+	return int64(len(ra.segs))
+}
+
+// Data returns the data for segment id, aliasing the buffer the arena was
+// constructed with.
+func (ra *ReadOnlyArena) Data(id SegmentID) ([]byte, error) {
+	if int64(id) >= ra.NumSegments() {
+		return nil, errSegmentNotFound
+	}
+	return ra.segs[id].data, nil
+}
+
+// Allocate always fails: a ReadOnlyArena serves existing bytes and cannot
+// grow or create segments.
+func (ra *ReadOnlyArena) Allocate(sz Size, segs map[SegmentID]*Segment) (SegmentID, []byte, error) {
+	return 0, nil, errReadOnlyArena
+}
+
+// String returns a short description of the arena for debugging.
+func (ra *ReadOnlyArena) String() string {
+	return "read-only arena"
+}
+
+// ResetForRead rebinds m to read from a new zero-copy arena, reusing m's
+// existing allocation (CapTable, Segment pool, etc.) instead of
+// allocating a fresh Message. It is meant for pooling Messages that only
+// ever read zero-copy data, one after another.
+//
+// Unlike a bare Reset, ResetForRead also clears m's TraversalTracker: the
+// previous arena's read-limit budget and visited-region set must not
+// carry over, or the pooled Message would start its next read already
+// part-way (or fully) spent and fail reads that are well within the
+// fresh arena's own budget.
+func (m *Message) ResetForRead(arena *ReadOnlyArena) {
+	m.Reset(arena)
+	m.tracker = nil
+	m.trackerOnce = sync.Once{}
+}
+
+var (
+	errReadOnlyArena   = errors.New("capnp: cannot allocate in a read-only arena")
+	errSegmentNotFound = errors.New("capnp: segment not found")
+)
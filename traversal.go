@@ -0,0 +1,159 @@
+package capnp
+
+import "sync"
+
+// defaultTraverseLimit is the read-traversal budget used when a Message's
+// TraverseLimit is left at its zero value, matching the meaning
+// TraverseLimit already has elsewhere: 0 means "use the default," not
+// "allow nothing."
+const defaultTraverseLimit = 64 << 20 // 64 MiB
+
+// A TraversalTracker enforces a message's read-traversal byte budget the
+// way the old per-Message counter did, but remembers which regions it has
+// already charged for. Re-entering a region already charged within the
+// same traversal is free, so a caller that walks the same subtree more
+// than once (Equal, canonicalization, an application-level visitor) is
+// not double-charged, and a recursive structure whose depthLimit would
+// otherwise mask how many times a given address is revisited cannot
+// silently blow through the intended budget.
+//
+// A TraversalTracker may be shared across goroutines reading the same
+// Message concurrently, same as the counter it replaces; all methods take
+// mu to keep that safe.
+//
+// The zero value is not usable; create one with NewTraversalTracker.
+type TraversalTracker struct {
+	mu        sync.Mutex
+	remaining int64
+	seen      map[SegmentID]*copyIntervalSet
+}
+
+// NewTraversalTracker returns a tracker with the given byte budget. limit
+// mirrors the TraverseLimit field on Message; a limit of 0 means the
+// default of 64 MiB, not zero bytes.
+func NewTraversalTracker(limit uint64) *TraversalTracker {
+	if limit == 0 {
+		limit = defaultTraverseLimit
+	}
+	return &TraversalTracker{
+		remaining: int64(limit),
+		seen:      make(map[SegmentID]*copyIntervalSet),
+	}
+}
+
+// Enter charges sz bytes against the tracker's budget for the region
+// [addr, addr+sz) in seg, unless that exact region has already been
+// charged earlier in the traversal, in which case it is free. It returns
+// errReadLimit if the budget is exhausted. The returned leave func must
+// be called once the caller is done using the region; the zero-value
+// implementation has nothing to release, but callers should still call
+// it so traversal scopes stay symmetric as the tracker evolves.
+func (t *TraversalTracker) Enter(seg *Segment, addr Address, sz Size) (leave func(), err error) {
+	noop := func() {}
+	if t == nil {
+		return noop, nil
+	}
+	end, ok := addr.addSize(sz)
+	if !ok {
+		return nil, errOverflow
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	set := t.setFor(seg.id)
+	if iv := set.find(addr, end); iv != nil && iv.start == addr && iv.end == end {
+		return noop, nil
+	}
+	if int64(sz) > t.remaining {
+		return nil, errReadLimit
+	}
+	t.remaining -= int64(sz)
+	set.insert(copyInterval{start: addr, end: end})
+	return noop, nil
+}
+
+// setFor must be called with t.mu held.
+func (t *TraversalTracker) setFor(id SegmentID) *copyIntervalSet {
+	set := t.seen[id]
+	if set == nil {
+		set = &copyIntervalSet{}
+		t.seen[id] = set
+	}
+	return set
+}
+
+// TraversalSnapshot is a saved state of a TraversalTracker, as returned by
+// Snapshot, that Restore can later roll the tracker back to.
+type TraversalSnapshot struct {
+	remaining int64
+	seen      map[SegmentID][]copyInterval
+}
+
+// Snapshot captures t's current budget and visited-region set so that a
+// caller (such as Equal, comparing two subtrees) can restore it
+// afterwards instead of permanently consuming budget from a tracker
+// shared with the rest of the message's traversals.
+func (t *TraversalTracker) Snapshot() TraversalSnapshot {
+	if t == nil {
+		return TraversalSnapshot{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	snap := TraversalSnapshot{
+		remaining: t.remaining,
+		seen:      make(map[SegmentID][]copyInterval, len(t.seen)),
+	}
+	for id, set := range t.seen {
+		ivs := make([]copyInterval, len(set.ivs))
+		copy(ivs, set.ivs)
+		snap.seen[id] = ivs
+	}
+	return snap
+}
+
+// Restore rolls t back to the state captured by Snapshot.
+func (t *TraversalTracker) Restore(snap TraversalSnapshot) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remaining = snap.remaining
+	t.seen = make(map[SegmentID]*copyIntervalSet, len(snap.seen))
+	for id, ivs := range snap.seen {
+		cp := make([]copyInterval, len(ivs))
+		copy(cp, ivs)
+		t.seen[id] = &copyIntervalSet{ivs: cp}
+	}
+}
+
+// traversalTracker returns m's TraversalTracker, lazily creating one from
+// m's configured traversal limit (TraverseLimit, where 0 means the
+// default) the first time it's needed. This keeps Messages that never
+// call SetTraversalTracker on a single budget shared by every read off
+// the message, as before. The lazy init runs under
+// m.trackerOnce, the same guard the old per-Message read-limit counter
+// used, so concurrent first reads of a Message don't race to create (and
+// clobber) the tracker.
+func (m *Message) traversalTracker() *TraversalTracker {
+	m.trackerOnce.Do(m.initTraversalTracker)
+	return m.tracker
+}
+
+func (m *Message) initTraversalTracker() {
+	if m.tracker == nil {
+		m.tracker = NewTraversalTracker(m.TraverseLimit)
+	}
+}
+
+// SetTraversalTracker installs t as the tracker used for all subsequent
+// reads off m. RPC servers that want to share one read budget across an
+// entire request, instead of one budget per Message, can construct a
+// single TraversalTracker and install it on every Message in that
+// request.
+//
+// SetTraversalTracker also consumes m.trackerOnce, so a later read off m
+// cannot race with this call to lazily install a different tracker.
+func (m *Message) SetTraversalTracker(t *TraversalTracker) {
+	m.trackerOnce.Do(func() {})
+	m.tracker = t
+}